@@ -1,15 +1,19 @@
+//go:build windows
 // +build windows
 
 package main
 
 import (
 	"crypto/md5"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -47,13 +51,38 @@ type logOpts struct {
 	MessagePattern string `long:"message-pattern" description:"Message Pattern (regexp pattern)"`
 	MessageExclude string `long:"message-exclude" description:"Message Pattern excluded (regexp pattern)"`
 	EventID        string `long:"event-id" description:"Event IDs (separated by comma)"`
+	Query          string `long:"query" description:"XPath query passed directly to EvtQuery (reads every --log channel, classic or modern, through EvtQuery)"`
 	WarnOver       int64  `short:"w" long:"warning-over" description:"Trigger a warning if matched lines is over a number"`
 	CritOver       int64  `short:"c" long:"critical-over" description:"Trigger a critical if matched lines is over a number"`
-	ReturnContent  bool   `short:"r" long:"return" description:"Return matched line"`
-	StateDir       string `short:"s" long:"state-dir" value-name:"DIR" description:"Dir to keep state files under"`
-	NoState        bool   `long:"no-state" description:"Don't use state file and read whole logs"`
-	FailFirst      bool   `long:"fail-first" description:"Count errors on first seek"`
-	Verbose        bool   `long:"verbose" description:"Verbose output"`
+
+	WarnCritical     int64 `long:"warn-critical" default:"-1" description:"Trigger a warning if Critical-level events are over a number"`
+	WarnError        int64 `long:"warn-error" default:"-1" description:"Trigger a warning if Error-level events are over a number"`
+	WarnWarning      int64 `long:"warn-warning" default:"-1" description:"Trigger a warning if Warning-level events are over a number"`
+	WarnAuditSuccess int64 `long:"warn-audit-success" default:"-1" description:"Trigger a warning if Audit Success events are over a number"`
+	WarnAuditFailure int64 `long:"warn-audit-failure" default:"-1" description:"Trigger a warning if Audit Failure events are over a number"`
+	WarnInformation  int64 `long:"warn-information" default:"-1" description:"Trigger a warning if Information-level events are over a number"`
+	CritCritical     int64 `long:"crit-critical" default:"-1" description:"Trigger a critical if Critical-level events are over a number"`
+	CritError        int64 `long:"crit-error" default:"-1" description:"Trigger a critical if Error-level events are over a number"`
+	CritWarning      int64 `long:"crit-warning" default:"-1" description:"Trigger a critical if Warning-level events are over a number"`
+	CritAuditSuccess int64 `long:"crit-audit-success" default:"-1" description:"Trigger a critical if Audit Success events are over a number"`
+	CritAuditFailure int64 `long:"crit-audit-failure" default:"-1" description:"Trigger a critical if Audit Failure events are over a number"`
+	CritInformation  int64 `long:"crit-information" default:"-1" description:"Trigger a critical if Information-level events are over a number"`
+
+	WarnEventID []string `long:"warn-event-id" description:"eventID:threshold (e.g. 4625:3); trigger a warning when that event ID occurs more than threshold times. Repeatable"`
+	CritEventID []string `long:"crit-event-id" description:"eventID:threshold (e.g. 4625:3); trigger a critical when that event ID occurs more than threshold times. Repeatable"`
+
+	ReturnContent bool   `short:"r" long:"return" description:"Return matched line"`
+	Format        string `long:"format" default:"text" description:"Output format for --return: text, json, or ltsv"`
+	StateDir      string `short:"s" long:"state-dir" value-name:"DIR" description:"Dir to keep state files under"`
+	NoState       bool   `long:"no-state" description:"Don't use state file and read whole logs"`
+	FailFirst     bool   `long:"fail-first" description:"Count errors on first seek"`
+	Verbose       bool   `long:"verbose" description:"Verbose output"`
+
+	Computer     string `long:"computer" description:"Read the event log from a remote computer instead of localhost"`
+	User         string `long:"user" description:"User name for --computer (requires --domain)"`
+	Domain       string `long:"domain" description:"Domain for --user"`
+	PasswordFile string `long:"password-file" description:"File holding the password for --user, to avoid passing it on the command line"`
+	Auth         string `long:"auth" default:"default" description:"Authentication for --computer: default, negotiate, or kerberos"`
 
 	logList        []string
 	typeList       []string
@@ -63,6 +92,10 @@ type logOpts struct {
 	messagePattern *regexp.Regexp
 	messageExclude *regexp.Regexp
 	origArgs       []string
+	password       string
+
+	warnEventIDThresholds map[uint32]int64
+	critEventIDThresholds map[uint32]int64
 }
 
 func stringList(s string) []string {
@@ -109,6 +142,46 @@ func idRangeList(s string) ([]idRange, error) {
 	return idrl, nil
 }
 
+// matchesIDRanges applies --event-id's include-minus-exclude semantics.
+func matchesIDRanges(id uint32, ranges []idRange) bool {
+	found := false
+	exact := false
+	for _, idr := range ranges {
+		inRange := idr.lo <= id && id <= idr.hi
+		if !idr.bang {
+			exact = true
+			if inRange {
+				found = true
+			}
+		} else if inRange {
+			found = false
+		} else if !exact {
+			found = true
+		}
+	}
+	return found
+}
+
+func eventIDThresholds(pairs []string) (map[uint32]int64, error) {
+	thresholds := make(map[uint32]int64, len(pairs))
+	for _, p := range pairs {
+		parts := strings.SplitN(p, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid eventID:threshold %q", p)
+		}
+		id, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid eventID:threshold %q: %v", p, err)
+		}
+		threshold, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid eventID:threshold %q: %v", p, err)
+		}
+		thresholds[uint32(id)] = threshold
+	}
+	return thresholds, nil
+}
+
 func (opts *logOpts) prepare() error {
 	opts.logList = stringList(opts.Log)
 	if len(opts.logList) == 0 || opts.logList[0] == "" {
@@ -148,9 +221,99 @@ func (opts *logOpts) prepare() error {
 			return err
 		}
 	}
+
+	if opts.Auth == "" {
+		opts.Auth = "default"
+	}
+	if _, ok := authFlagByName[opts.Auth]; !ok {
+		return fmt.Errorf("invalid --auth %q: must be one of default, negotiate, kerberos", opts.Auth)
+	}
+	if opts.User != "" && opts.Domain == "" {
+		return fmt.Errorf("--user requires --domain")
+	}
+
+	if opts.Format == "" {
+		opts.Format = "text"
+	}
+	switch opts.Format {
+	case "text", "json", "ltsv":
+	default:
+		return fmt.Errorf("invalid --format %q: must be one of text, json, ltsv", opts.Format)
+	}
+	if opts.PasswordFile != "" {
+		b, err := ioutil.ReadFile(opts.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("--password-file: %w", err)
+		}
+		opts.password = strings.TrimRight(string(b), "\r\n")
+	}
+
+	if len(opts.WarnEventID) > 0 {
+		opts.warnEventIDThresholds, err = eventIDThresholds(opts.WarnEventID)
+		if err != nil {
+			return fmt.Errorf("--warn-event-id: %w", err)
+		}
+	}
+	if len(opts.CritEventID) > 0 {
+		opts.critEventIDThresholds, err = eventIDThresholds(opts.CritEventID)
+		if err != nil {
+			return fmt.Errorf("--crit-event-id: %w", err)
+		}
+	}
 	return nil
 }
 
+type levelRule struct {
+	name     string
+	warnOver int64
+	critOver int64
+}
+
+// levelRules orders levels worst-first, so the breakdown reads most severe first.
+func (opts *logOpts) levelRules() []levelRule {
+	return []levelRule{
+		{"Critical", opts.WarnCritical, opts.CritCritical},
+		{"Error", opts.WarnError, opts.CritError},
+		{"Audit Failure", opts.WarnAuditFailure, opts.CritAuditFailure},
+		{"Warning", opts.WarnWarning, opts.CritWarning},
+		{"Audit Success", opts.WarnAuditSuccess, opts.CritAuditSuccess},
+		{"Information", opts.WarnInformation, opts.CritInformation},
+	}
+}
+
+type eventIDRule struct {
+	id       uint32
+	warnOver int64
+	critOver int64
+}
+
+// eventIDRules merges the warn/crit thresholds per event ID, defaulting an
+// unset side to -1 ("never fires"), sorted by ID.
+func (opts *logOpts) eventIDRules() []eventIDRule {
+	ids := make(map[uint32]struct{}, len(opts.warnEventIDThresholds)+len(opts.critEventIDThresholds))
+	for id := range opts.warnEventIDThresholds {
+		ids[id] = struct{}{}
+	}
+	for id := range opts.critEventIDThresholds {
+		ids[id] = struct{}{}
+	}
+
+	rules := make([]eventIDRule, 0, len(ids))
+	for id := range ids {
+		warnOver, ok := opts.warnEventIDThresholds[id]
+		if !ok {
+			warnOver = -1
+		}
+		critOver, ok := opts.critEventIDThresholds[id]
+		if !ok {
+			critOver = -1
+		}
+		rules = append(rules, eventIDRule{id: id, warnOver: warnOver, critOver: critOver})
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].id < rules[j].id })
+	return rules
+}
+
 func main() {
 	ckr := run(os.Args[1:])
 	ckr.Name = "Event Log"
@@ -173,6 +336,27 @@ func parseArgs(args []string) (*logOpts, error) {
 	return opts, err
 }
 
+// statusRank orders checkers.Status from least to most severe.
+func statusRank(s checkers.Status) int {
+	switch s {
+	case checkers.CRITICAL:
+		return 3
+	case checkers.WARNING:
+		return 2
+	case checkers.UNKNOWN:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func worstStatus(a, b checkers.Status) checkers.Status {
+	if statusRank(b) > statusRank(a) {
+		return b
+	}
+	return a
+}
+
 func run(args []string) *checkers.Checker {
 	opts, err := parseArgs(args)
 	if err != nil {
@@ -187,29 +371,57 @@ func run(args []string) *checkers.Checker {
 	checkSt := checkers.OK
 	warnNum := int64(0)
 	critNum := int64(0)
-	errorOverall := ""
+	ew := newEventWriter(opts.Format)
+	levelCounts := make(map[string]int64)
+	eventIDCounts := make(map[uint32]int64)
 
 	for _, lt := range opts.logList {
-		w, c, errLines, err := opts.searchLog(lt)
+		w, c, err := opts.searchLog(lt, ew, levelCounts, eventIDCounts)
 		if err != nil {
 			return checkers.Unknown(err.Error())
 		}
 		warnNum += w
 		critNum += c
-		if opts.ReturnContent {
-			errorOverall += errLines
-		}
 	}
+
 	msg := fmt.Sprintf("%d warnings, %d criticals.", warnNum, critNum)
-	if errorOverall != "" {
-		msg += "\n" + errorOverall
-	}
 	if warnNum > opts.WarnOver {
 		checkSt = checkers.WARNING
 	}
 	if critNum > opts.CritOver {
 		checkSt = checkers.CRITICAL
 	}
+
+	var breakdown []string
+	for _, r := range opts.levelRules() {
+		n := levelCounts[r.name]
+		switch {
+		case r.critOver >= 0 && n > r.critOver:
+			checkSt = worstStatus(checkSt, checkers.CRITICAL)
+			breakdown = append(breakdown, fmt.Sprintf("%s: %d (over %d, critical)", r.name, n, r.critOver))
+		case r.warnOver >= 0 && n > r.warnOver:
+			checkSt = worstStatus(checkSt, checkers.WARNING)
+			breakdown = append(breakdown, fmt.Sprintf("%s: %d (over %d, warning)", r.name, n, r.warnOver))
+		}
+	}
+	for _, r := range opts.eventIDRules() {
+		n := eventIDCounts[r.id]
+		switch {
+		case r.critOver >= 0 && n > r.critOver:
+			checkSt = worstStatus(checkSt, checkers.CRITICAL)
+			breakdown = append(breakdown, fmt.Sprintf("event ID %d: %d (over %d, critical)", r.id, n, r.critOver))
+		case r.warnOver >= 0 && n > r.warnOver:
+			checkSt = worstStatus(checkSt, checkers.WARNING)
+			breakdown = append(breakdown, fmt.Sprintf("event ID %d: %d (over %d, warning)", r.id, n, r.warnOver))
+		}
+	}
+	if len(breakdown) > 0 {
+		msg += "\n" + strings.Join(breakdown, "\n")
+	}
+
+	if opts.ReturnContent && ew.Len() > 0 {
+		msg += "\n" + ew.String()
+	}
 	return checkers.NewChecker(checkSt, msg)
 }
 
@@ -226,11 +438,51 @@ func bytesToString(b []byte) (string, uint32) {
 	return string(utf16.Decode(s)), uint32(i * 2)
 }
 
-func getResourceMessage(providerName, sourceName string, eventID uint32, argsptr uintptr) (string, error) {
+// registryOpenRemoteKey is indirected so tests can fake --computer's registry access.
+var registryOpenRemoteKey = registry.OpenRemoteKey
+
+// evtOpenSession is indirected so tests can fake --computer's session setup.
+var evtOpenSession = eventlog.EvtOpenSession
+
+// openSession returns the zero handle for the local machine, which EvtQuery
+// and EvtOpenPublisherMetadata already treat as "this machine".
+func (opts *logOpts) openSession() (eventlog.EvtHandle, error) {
+	if opts.Computer == "" {
+		return 0, nil
+	}
+	return evtOpenSession(opts.Computer, opts.User, opts.Domain, opts.password, authFlagByName[opts.Auth])
+}
+
+func openEventLogServiceKey(computer, providerName, sourceName string) (registry.Key, error) {
 	regkey := fmt.Sprintf(
 		"SYSTEM\\CurrentControlSet\\Services\\EventLog\\%s\\%s",
 		providerName, sourceName)
-	key, err := registry.OpenKey(registry.LOCAL_MACHINE, regkey, registry.QUERY_VALUE)
+
+	base := registry.Key(registry.LOCAL_MACHINE)
+	if computer != "" {
+		remote, err := registryOpenRemoteKey(computer, registry.LOCAL_MACHINE)
+		if err != nil {
+			return 0, err
+		}
+		defer remote.Close()
+		base = remote
+	}
+	return registry.OpenKey(base, regkey, registry.QUERY_VALUE)
+}
+
+// resolveMessage falls back to the raw insertion strings when
+// getResourceMessage couldn't load the message DLL from a remote computer.
+func resolveMessage(message string, err error, computer string, argStrings []string) string {
+	if err != nil && computer != "" {
+		return strings.Join(argStrings, " ")
+	}
+	return message
+}
+
+// getResourceMessage resolves eventID against the message DLL that sourceName
+// registered for providerName, formatting it with the event's insertion strings.
+func getResourceMessage(computer, providerName, sourceName string, eventID uint32, argsptr uintptr) (string, error) {
+	key, err := openEventLogServiceKey(computer, providerName, sourceName)
 	if err != nil {
 		return "", err
 	}
@@ -272,19 +524,480 @@ func getResourceMessage(providerName, sourceName string, eventID uint32, argsptr
 	return message, nil
 }
 
-func (opts *logOpts) searchLog(logName string) (warnNum, critNum int64, errLines string, err error) {
+// isModernChannel reports whether logName is a modern per-provider channel
+// (e.g. "Microsoft-Windows-WinRM/Operational"), only reachable via EvtQuery.
+func isModernChannel(logName string) bool {
+	return strings.Contains(logName, "/")
+}
+
+func remoteHostPtr(computer string) *uint16 {
+	if computer == "" {
+		return nil
+	}
+	return syscall.StringToUTF16Ptr(computer)
+}
+
+func (opts *logOpts) searchLog(logName string, w *eventWriter, levelCounts map[string]int64, eventIDCounts map[uint32]int64) (warnNum, critNum int64, err error) {
+	if opts.Query != "" || isModernChannel(logName) {
+		return opts.searchLogModern(logName, w, levelCounts, eventIDCounts)
+	}
+	return opts.searchLogLegacy(logName, w, levelCounts, eventIDCounts)
+}
+
+// buildXPathFilter translates --type/--event-id/--source-pattern into an
+// EvtQuery System predicate. It is only a superset filter for --event-id:
+// "!"-exclusion and the no-include-ranges case still need matchesIDRanges
+// once events come back, same as --message-pattern, which has no XPath
+// equivalent at all.
+func (opts *logOpts) buildXPathFilter() string {
+	var predicates []string
+
+	if len(opts.typeList) > 0 {
+		var levels []string
+		for _, t := range opts.typeList {
+			switch t {
+			case "Audit Success":
+				levels = append(levels, fmt.Sprintf("band(Keywords,%d)", keywordAuditSuccess))
+			case "Audit Failure":
+				levels = append(levels, fmt.Sprintf("band(Keywords,%d)", keywordAuditFailure))
+			default:
+				if lvl, ok := levelValueByName[t]; ok {
+					levels = append(levels, fmt.Sprintf("Level=%d", lvl))
+				}
+				// levelName also reports Level 0 (LogAlways) as Information.
+				if t == "Information" {
+					levels = append(levels, "Level=0")
+				}
+			}
+		}
+		if len(levels) > 0 {
+			predicates = append(predicates, "("+strings.Join(levels, " or ")+")")
+		}
+	}
+
+	// Only the include ranges are pushed down; matchesIDRanges handles "!" ranges.
+	var includes []string
+	for _, idr := range opts.idRangeList {
+		if !idr.bang {
+			includes = append(includes, fmt.Sprintf("(EventID>=%d and EventID<=%d)", idr.lo, idr.hi))
+		}
+	}
+	if len(includes) > 0 {
+		predicates = append(predicates, "("+strings.Join(includes, " or ")+")")
+	}
+
+	// "contains", not "=", to match opts.sourcePattern's unanchored substring
+	// semantics; skipped for patterns with a "'", which XPath 1.0 can't escape.
+	if opts.sourcePattern != nil && !strings.ContainsAny(opts.SourcePattern, `.*+?()[]{}|^$\'`) {
+		predicates = append(predicates, fmt.Sprintf("Provider[contains(@Name,'%s')]", opts.SourcePattern))
+	}
+
+	if len(predicates) == 0 {
+		return "*"
+	}
+	return "*[System[" + strings.Join(predicates, " and ") + "]]"
+}
+
+// addMinRecordIDPredicate splices an "EventRecordID>id" predicate into a
+// buildXPathFilter query, for a transition run seeded from a legacy
+// record-number state file.
+func addMinRecordIDPredicate(query string, id uint64) string {
+	predicate := fmt.Sprintf("EventRecordID>%d", id)
+	if query == "*" {
+		return "*[System[" + predicate + "]]"
+	}
+	return strings.TrimSuffix(query, "]]") + " and " + predicate + "]]"
+}
+
+var levelValueByName = map[string]uint8{
+	"Critical":    1,
+	"Error":       2,
+	"Warning":     3,
+	"Information": 4,
+	"Verbose":     5,
+}
+
+var authFlagByName = map[string]uint32{
+	"default":   eventlog.EvtRpcLoginAuthDefault,
+	"negotiate": eventlog.EvtRpcLoginAuthNegotiate,
+	"kerberos":  eventlog.EvtRpcLoginAuthKerberos,
+}
+
+// Audit Success/Failure have no System/Level value; they're Keywords bits instead.
+const (
+	keywordAuditSuccess = 0x0020000000000000
+	keywordAuditFailure = 0x0010000000000000
+)
+
+func levelName(level uint8, keywords uint64) string {
+	switch {
+	case keywords&keywordAuditFailure != 0:
+		return "Audit Failure"
+	case keywords&keywordAuditSuccess != 0:
+		return "Audit Success"
+	}
+	switch level {
+	case 1:
+		return "Critical"
+	case 2:
+		return "Error"
+	case 3:
+		return "Warning"
+	case 4, 0:
+		return "Information"
+	case 5:
+		return "Verbose"
+	default:
+		return "Information"
+	}
+}
+
+type renderedEvent struct {
+	XMLName xml.Name `xml:"Event"`
+	System  struct {
+		Provider struct {
+			Name string `xml:"Name,attr"`
+		} `xml:"Provider"`
+		EventID     uint32 `xml:"EventID"`
+		Level       uint8  `xml:"Level"`
+		Keywords    string `xml:"Keywords"`
+		TimeCreated struct {
+			SystemTime string `xml:"SystemTime,attr"`
+		} `xml:"TimeCreated"`
+		EventRecordID uint64 `xml:"EventRecordID"`
+		Channel       string `xml:"Channel"`
+		Computer      string `xml:"Computer"`
+	} `xml:"System"`
+	EventData struct {
+		Data []struct {
+			Name  string `xml:"Name,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"Data"`
+	} `xml:"EventData"`
+}
+
+func (e *renderedEvent) keywordsUint64() uint64 {
+	k := strings.TrimPrefix(e.System.Keywords, "0x")
+	v, _ := strconv.ParseUint(k, 16, 64)
+	return v
+}
+
+// matchedEvent is the structured form of a --return'd event. Data is only
+// populated by the EvtQuery backend; the legacy backend only has positional
+// insertion strings.
+type matchedEvent struct {
+	RecordNumber  uint64            `json:"record_number"`
+	TimeGenerated string            `json:"time_generated,omitempty"`
+	TimeWritten   string            `json:"time_written,omitempty"`
+	EventID       uint32            `json:"event_id"`
+	Level         string            `json:"level"`
+	Channel       string            `json:"channel"`
+	Provider      string            `json:"provider"`
+	Computer      string            `json:"computer"`
+	Message       string            `json:"message"`
+	Data          map[string]string `json:"data,omitempty"`
+}
+
+// eventWriter accumulates --return output as text, json, or ltsv.
+type eventWriter struct {
+	format string
+	buf    strings.Builder
+}
+
+func newEventWriter(format string) *eventWriter {
+	return &eventWriter{format: format}
+}
+
+func (w *eventWriter) Len() int {
+	return w.buf.Len()
+}
+
+func (w *eventWriter) String() string {
+	return strings.TrimSuffix(w.buf.String(), "\n")
+}
+
+func (w *eventWriter) Write(ev matchedEvent) {
+	switch w.format {
+	case "json":
+		b, err := json.Marshal(&ev)
+		if err != nil {
+			log.Printf("json.Marshal: %v", err)
+			return
+		}
+		w.buf.Write(b)
+		w.buf.WriteByte('\n')
+	case "ltsv":
+		fields := []string{
+			"record_number:" + strconv.FormatUint(ev.RecordNumber, 10),
+			"time_generated:" + ev.TimeGenerated,
+			"time_written:" + ev.TimeWritten,
+			"event_id:" + strconv.FormatUint(uint64(ev.EventID), 10),
+			"level:" + ev.Level,
+			"channel:" + ev.Channel,
+			"provider:" + ev.Provider,
+			"computer:" + ev.Computer,
+			"message:" + ltsvEscape(ev.Message),
+		}
+		for k, v := range ev.Data {
+			fields = append(fields, "data."+k+":"+ltsvEscape(v))
+		}
+		w.buf.WriteString(strings.Join(fields, "\t"))
+		w.buf.WriteByte('\n')
+	default:
+		w.buf.WriteString(ev.Provider + ":" + strings.Replace(ev.Message, "\n", "", -1) + "\n")
+	}
+}
+
+func ltsvEscape(s string) string {
+	s = strings.Replace(s, "\t", " ", -1)
+	s = strings.Replace(s, "\n", " ", -1)
+	return s
+}
+
+// searchLogModern is the EvtQuery-based backend for modern per-provider
+// channels (and for any channel when --query is given explicitly).
+func (opts *logOpts) searchLogModern(logName string, w *eventWriter, levelCounts map[string]int64, eventIDCounts map[uint32]int64) (warnNum, critNum int64, err error) {
+	stateFile := opts.getStateFile(logName)
+
+	var bookmarkXML string
+	var minRecordID uint64
+	firstRun := false
+	if !opts.NoState {
+		st, legacyRecordNumber, isLegacy, rerr := readEventlogState(stateFile)
+		switch {
+		case rerr != nil && os.IsNotExist(rerr):
+			firstRun = true
+		case rerr != nil:
+			return 0, 0, rerr
+		case isLegacy:
+			// Transition run from a pre-bookmark state file: fall back to the
+			// old record number this once; the JSON+bookmark format takes
+			// over once we write the state file again below.
+			if opts.Query == "" {
+				minRecordID = uint64(legacyRecordNumber)
+			} else {
+				// An explicit --query can't be safely spliced with an extra
+				// EventRecordID predicate, so treat it like a first run.
+				firstRun = true
+			}
+		default:
+			bookmarkXML = st.BookmarkXML
+			if bookmarkXML == "" {
+				firstRun = true
+			}
+		}
+	}
+
+	query := opts.Query
+	if query == "" {
+		query = opts.buildXPathFilter()
+		if minRecordID > 0 {
+			query = addMinRecordIDPredicate(query, minRecordID)
+		}
+	}
+
+	session, err := opts.openSession()
+	if err != nil {
+		return 0, 0, fmt.Errorf("EvtOpenSession(%s): %w", opts.Computer, err)
+	}
+	if session != 0 {
+		defer eventlog.EvtClose(session)
+	}
+
+	resultSet, err := eventlog.EvtQuery(session, logName, query, eventlog.EvtQueryChannelPath|eventlog.EvtQueryForwardDirection)
+	if err != nil {
+		return 0, 0, fmt.Errorf("EvtQuery(%s, %s): %w", logName, query, err)
+	}
+	defer eventlog.EvtClose(resultSet)
+
+	if bookmarkXML != "" {
+		seekBookmark, berr := eventlog.EvtCreateBookmark(bookmarkXML)
+		if berr != nil {
+			return 0, 0, fmt.Errorf("EvtCreateBookmark: %w", berr)
+		}
+		defer eventlog.EvtClose(seekBookmark)
+		if serr := eventlog.EvtSeek(resultSet, 1, seekBookmark, eventlog.EvtSeekRelativeToBookmark); serr != nil {
+			return 0, 0, fmt.Errorf("EvtSeek: %w", serr)
+		}
+	}
+
+	// Publisher metadata is opened lazily per provider name, since each
+	// provider needs its own metadata handle to resolve its message template.
+	pubCache := make(map[string]eventlog.EvtHandle)
+	defer func() {
+		for _, h := range pubCache {
+			if h != 0 {
+				eventlog.EvtClose(h)
+			}
+		}
+	}()
+
+	bookmark, err := eventlog.EvtCreateBookmark("")
+	if err != nil {
+		return 0, 0, fmt.Errorf("EvtCreateBookmark: %w", err)
+	}
+	defer eventlog.EvtClose(bookmark)
+
+	seenAny := false
+	handles := make([]eventlog.EvtHandle, 32)
+eventLoop:
+	for {
+		events, nerr := eventlog.EvtNext(resultSet, handles, 1000)
+		if nerr != nil {
+			err = fmt.Errorf("EvtNext: %w", nerr)
+			break eventLoop
+		}
+		if len(events) == 0 {
+			break
+		}
+
+		for _, h := range events {
+			eventlog.EvtUpdateBookmark(bookmark, h)
+			seenAny = true
+
+			if firstRun && !opts.FailFirst {
+				eventlog.EvtClose(h)
+				continue
+			}
+
+			xmlBytes, rerr := eventlog.RenderEventXML(h)
+			if rerr != nil {
+				log.Printf("eventlog.RenderEventXML: %v", rerr)
+				eventlog.EvtClose(h)
+				continue
+			}
+
+			var ev renderedEvent
+			if uerr := xml.Unmarshal(xmlBytes, &ev); uerr != nil {
+				log.Printf("xml.Unmarshal: %v", uerr)
+				eventlog.EvtClose(h)
+				continue
+			}
+
+			if opts.idRangeList != nil && !matchesIDRanges(ev.System.EventID, opts.idRangeList) {
+				eventlog.EvtClose(h)
+				continue
+			}
+			if opts.sourcePattern != nil && !opts.sourcePattern.MatchString(ev.System.Provider.Name) {
+				eventlog.EvtClose(h)
+				continue
+			}
+			if opts.sourceExclude != nil && opts.sourceExclude.MatchString(ev.System.Provider.Name) {
+				eventlog.EvtClose(h)
+				continue
+			}
+
+			// The pushed-down Level/Keywords predicate is a superset filter
+			// too, so --type is actually enforced here, not by the pushdown.
+			level := levelName(ev.System.Level, ev.keywordsUint64())
+			if len(opts.typeList) > 0 {
+				found := false
+				for _, t := range opts.typeList {
+					if t == level {
+						found = true
+						break
+					}
+				}
+				if !found {
+					eventlog.EvtClose(h)
+					continue
+				}
+			}
+
+			pub, ok := pubCache[ev.System.Provider.Name]
+			if !ok {
+				newPub, perr := eventlog.EvtOpenPublisherMetadata(session, ev.System.Provider.Name)
+				if perr != nil {
+					newPub = 0
+				}
+				pubCache[ev.System.Provider.Name] = newPub
+				pub = newPub
+			}
+
+			message := ""
+			if pub != 0 {
+				if m, merr := eventlog.EvtFormatMessage(pub, h, eventlog.EvtFormatMessageEvent); merr == nil {
+					message = strings.TrimSuffix(strings.Replace(m, "\r", "", -1), "\n")
+				}
+			}
+			eventlog.EvtClose(h)
+
+			if opts.messagePattern != nil && !opts.messagePattern.MatchString(message) {
+				continue
+			}
+			if opts.messageExclude != nil && opts.messageExclude.MatchString(message) {
+				continue
+			}
+
+			if opts.Verbose {
+				log.Printf("RecordNumber=%v EventID=%v Channel=%v", ev.System.EventRecordID, ev.System.EventID, ev.System.Channel)
+			}
+
+			levelCounts[level]++
+			eventIDCounts[ev.System.EventID]++
+
+			if opts.ReturnContent {
+				if message == "" {
+					message = "[mackerel-agent] No message resource found. Please make sure the event log occured on the server."
+				}
+				data := make(map[string]string, len(ev.EventData.Data))
+				for _, d := range ev.EventData.Data {
+					data[d.Name] = d.Value
+				}
+				w.Write(matchedEvent{
+					RecordNumber:  ev.System.EventRecordID,
+					TimeGenerated: ev.System.TimeCreated.SystemTime,
+					EventID:       ev.System.EventID,
+					Level:         level,
+					Channel:       ev.System.Channel,
+					Provider:      ev.System.Provider.Name,
+					Computer:      ev.System.Computer,
+					Message:       strings.Replace(message, "\n", "", -1),
+					Data:          data,
+				})
+			}
+
+			switch level {
+			case "Error", "Audit Failure", "Critical":
+				critNum++
+			case "Warning":
+				warnNum++
+			}
+		}
+	}
+
+	if !opts.NoState && seenAny {
+		bmXML, rerr := eventlog.RenderBookmark(bookmark)
+		if rerr != nil {
+			log.Printf("eventlog.RenderBookmark: %v", rerr)
+		} else if werr := writeEventlogState(stateFile, logName, opts.argsMD5(), string(bmXML)); werr != nil {
+			log.Printf("writeEventlogState failed: %s\n", werr.Error())
+		}
+	}
+
+	if err != nil {
+		return warnNum, critNum, err
+	}
+	if firstRun && !opts.FailFirst {
+		return 0, 0, nil
+	}
+	return warnNum, critNum, nil
+}
+
+func (opts *logOpts) searchLogLegacy(logName string, w *eventWriter, levelCounts map[string]int64, eventIDCounts map[uint32]int64) (warnNum, critNum int64, err error) {
 	stateFile := opts.getStateFile(logName)
 	recordNumber := uint32(0)
 	if !opts.NoState {
 		s, err := getLastOffset(stateFile)
 		if err != nil && !os.IsNotExist(err) {
-			return 0, 0, "", err
+			return 0, 0, err
 		}
 		recordNumber = uint32(s)
 	}
 
+	hostPtr := remoteHostPtr(opts.Computer)
 	ptr := syscall.StringToUTF16Ptr(logName)
-	h, err := eventlog.OpenEventLog(nil, ptr)
+	h, err := eventlog.OpenEventLog(hostPtr, ptr)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -304,13 +1017,13 @@ func (opts *logOpts) searchLog(logName string) (warnNum, critNum int64, errLines
 	if recordNumber == 0 {
 		if !opts.NoState && !opts.FailFirst {
 			err = writeLastOffset(stateFile, int64(oldnum+num-1))
-			return 0, 0, "", err
+			return 0, 0, err
 		}
 	}
 
 	if oldnum <= recordNumber {
 		if recordNumber == oldnum+num-1 {
-			return 0, 0, "", nil
+			return 0, 0, nil
 		}
 		lastNumber = recordNumber
 		recordNumber++
@@ -342,7 +1055,7 @@ loop_events:
 		if err != nil {
 			if err != syscall.ERROR_INSUFFICIENT_BUFFER {
 				if err != errorInvalidParameter {
-					return 0, 0, "", err
+					return 0, 0, err
 				}
 				break
 			}
@@ -374,23 +1087,7 @@ loop_events:
 		if opts.idRangeList != nil {
 			// even code takes last 4 bytes
 			eventID := r.EventID & 0x0000FFFF
-			found := false
-			exact := false
-			for _, idr := range opts.idRangeList {
-				if !idr.bang {
-					exact = true
-					if idr.lo <= eventID && eventID <= idr.hi {
-						found = true
-					}
-				} else {
-					if idr.lo <= eventID && eventID <= idr.hi {
-						found = false
-					} else if !exact {
-						found = true
-					}
-				}
-			}
-			if !found {
+			if !matchesIDRanges(eventID, opts.idRangeList) {
 				continue loop_events
 			}
 		}
@@ -434,9 +1131,11 @@ loop_events:
 
 		off := uint32(0)
 		args := make([]*byte, uintptr(r.NumStrings)*unsafe.Sizeof((*uint16)(nil)))
+		argStrings := make([]string, r.NumStrings)
 		for n := 0; n < int(r.NumStrings); n++ {
 			args[n] = &buf[r.StringOffset+off]
-			_, boff := bytesToString(buf[r.StringOffset+off:])
+			s, boff := bytesToString(buf[r.StringOffset+off:])
+			argStrings[n] = s
 			off += boff + 2
 		}
 
@@ -444,7 +1143,8 @@ loop_events:
 		if r.NumStrings > 0 {
 			argsptr = uintptr(unsafe.Pointer(&args[0]))
 		}
-		message, _ := getResourceMessage(logName, sourceName, r.EventID, argsptr)
+		message, merr := getResourceMessage(opts.Computer, logName, sourceName, r.EventID, argsptr)
+		message = resolveMessage(message, merr, opts.Computer, argStrings)
 		if opts.Verbose {
 			log.Printf("Message=%v", message)
 		}
@@ -466,8 +1166,22 @@ loop_events:
 			if message == "" {
 				message = "[mackerel-agent] No message resource found. Please make sure the event log occured on the server."
 			}
-			errLines += sourceName + ":" + strings.Replace(message, "\n", "", -1) + "\n"
+			w.Write(matchedEvent{
+				RecordNumber:  uint64(r.RecordNumber),
+				TimeGenerated: time.Unix(int64(r.TimeGenerated), 0).Format(time.RFC3339),
+				TimeWritten:   time.Unix(int64(r.TimeWritten), 0).Format(time.RFC3339),
+				EventID:       r.EventID & 0x0000FFFF,
+				Level:         tn,
+				Channel:       logName,
+				Provider:      sourceName,
+				Computer:      computerName,
+				Message:       strings.Replace(message, "\n", "", -1),
+			})
 		}
+
+		levelCounts[tn]++
+		eventIDCounts[r.EventID&0x0000FFFF]++
+
 		switch tn {
 		case "Error":
 			critNum++
@@ -486,9 +1200,9 @@ loop_events:
 	}
 
 	if recordNumber == 0 && !opts.FailFirst {
-		return 0, 0, "", nil
+		return 0, 0, nil
 	}
-	return warnNum, critNum, errLines, nil
+	return warnNum, critNum, nil
 }
 
 var stateRe = regexp.MustCompile(`^([A-Z]):[/\\]`)
@@ -504,6 +1218,60 @@ func (opts *logOpts) getStateFile(logName string) string {
 	)
 }
 
+// stateSchemaVersion is bumped when the JSON shape of eventlogState changes.
+const stateSchemaVersion = 2
+
+// eventlogState is the modern-backend state file format, wrapping the
+// EvtCreateBookmark XML that resumes the query where the last run left off.
+// It replaces the bare record-number files written by writeLastOffset, which
+// remain readable for one transition run (see readEventlogState).
+type eventlogState struct {
+	Version     int    `json:"version"`
+	Channel     string `json:"channel"`
+	ArgsMD5     string `json:"args_md5"`
+	BookmarkXML string `json:"bookmark_xml"`
+}
+
+func (opts *logOpts) argsMD5() string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(strings.Join(opts.origArgs, " "))))
+}
+
+// readEventlogState reads a state file written by writeEventlogState or the
+// legacy writeLastOffset; isLegacy reports the latter.
+func readEventlogState(f string) (st *eventlogState, legacyRecordNumber int64, isLegacy bool, err error) {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	var s eventlogState
+	if jerr := json.Unmarshal(b, &s); jerr == nil && s.Version > 0 {
+		return &s, 0, false, nil
+	}
+
+	n, perr := strconv.ParseInt(strings.Trim(string(b), " \r\n"), 10, 64)
+	if perr != nil {
+		return nil, 0, false, fmt.Errorf("%s: unrecognized event log state file", f)
+	}
+	return nil, n, true, nil
+}
+
+func writeEventlogState(f, channel, argsMD5, bookmarkXML string) error {
+	b, err := json.Marshal(&eventlogState{
+		Version:     stateSchemaVersion,
+		Channel:     channel,
+		ArgsMD5:     argsMD5,
+		BookmarkXML: bookmarkXML,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f, b, 0644)
+}
+
 func getLastOffset(f string) (int64, error) {
 	_, err := os.Stat(f)
 	if err != nil {
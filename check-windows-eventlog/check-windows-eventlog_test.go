@@ -0,0 +1,405 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/windows/registry"
+
+	"github.com/mackerelio/go-check-plugins/check-windows-eventlog/internal/eventlog"
+)
+
+func TestPrepareAuth(t *testing.T) {
+	tests := []struct {
+		auth    string
+		wantErr bool
+	}{
+		{"", false},
+		{"default", false},
+		{"negotiate", false},
+		{"kerberos", false},
+		{"ntlm", true},
+	}
+	for _, tt := range tests {
+		opts := &logOpts{Auth: tt.auth}
+		err := opts.prepare()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("prepare() with Auth=%q: err=%v, wantErr=%v", tt.auth, err, tt.wantErr)
+		}
+		if err == nil && opts.Auth == "" {
+			t.Errorf("prepare() left Auth empty, want default")
+		}
+	}
+}
+
+func TestPrepareUserRequiresDomain(t *testing.T) {
+	tests := []struct {
+		user, domain string
+		wantErr      bool
+	}{
+		{"", "", false},
+		{"", "CORP", false},
+		{"alice", "CORP", false},
+		{"alice", "", true},
+	}
+	for _, tt := range tests {
+		opts := &logOpts{User: tt.user, Domain: tt.domain}
+		err := opts.prepare()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("prepare() with User=%q Domain=%q: err=%v, wantErr=%v", tt.user, tt.domain, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPreparePasswordFile(t *testing.T) {
+	dir := t.TempDir()
+	f := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(f, []byte("hunter2\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &logOpts{PasswordFile: f}
+	if err := opts.prepare(); err != nil {
+		t.Fatalf("prepare(): %v", err)
+	}
+	if opts.password != "hunter2" {
+		t.Errorf("password = %q, want %q", opts.password, "hunter2")
+	}
+
+	opts = &logOpts{PasswordFile: filepath.Join(dir, "missing")}
+	if err := opts.prepare(); err == nil {
+		t.Errorf("prepare() with missing --password-file: want error, got nil")
+	}
+}
+
+func TestResolveMessage(t *testing.T) {
+	argStrings := []string{"foo", "bar"}
+
+	if got := resolveMessage("resolved", nil, "", argStrings); got != "resolved" {
+		t.Errorf("local success: got %q, want %q", got, "resolved")
+	}
+	if got := resolveMessage("", errors.New("no dll"), "", argStrings); got != "" {
+		t.Errorf("local failure: got %q, want empty (unchanged legacy behavior)", got)
+	}
+	if got, want := resolveMessage("", errors.New("no dll"), "host1", argStrings), "foo bar"; got != want {
+		t.Errorf("remote failure: got %q, want %q", got, want)
+	}
+	if got := resolveMessage("resolved", nil, "host1", argStrings); got != "resolved" {
+		t.Errorf("remote success: got %q, want %q", got, "resolved")
+	}
+}
+
+// fakeRemoteKeyPath is the HKCU tree a fake registryOpenRemoteKey stands in
+// for a real remote HKEY_LOCAL_MACHINE, so the tests below can drive
+// openEventLogServiceKey/getResourceMessage's --computer wiring without an
+// actual remote RPC connection.
+const fakeRemoteKeyPath = `Software\check-windows-eventlog-test`
+
+// withFakeRemoteKey creates a throwaway HKCU key, makes registryOpenRemoteKey
+// return it for any host instead of dialing out, and returns the key so the
+// caller can seed it with EventLog service values. It restores
+// registryOpenRemoteKey and deletes the test key on cleanup.
+func withFakeRemoteKey(t *testing.T) registry.Key {
+	t.Helper()
+	base, _, err := registry.CreateKey(registry.CURRENT_USER, fakeRemoteKeyPath, registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("CreateKey: %v", err)
+	}
+	t.Cleanup(func() {
+		base.Close()
+		deleteKeyTree(registry.CURRENT_USER, fakeRemoteKeyPath)
+	})
+
+	orig := registryOpenRemoteKey
+	registryOpenRemoteKey = func(pcname string, k registry.Key) (registry.Key, error) {
+		return base, nil
+	}
+	t.Cleanup(func() { registryOpenRemoteKey = orig })
+	return base
+}
+
+// deleteKeyTree deletes path under k together with its subkeys, since
+// registry.DeleteKey only removes a key that has none.
+func deleteKeyTree(k registry.Key, path string) {
+	if sub, err := registry.OpenKey(k, path, registry.ALL_ACCESS); err == nil {
+		names, _ := sub.ReadSubKeyNames(-1)
+		for _, name := range names {
+			deleteKeyTree(sub, name)
+		}
+		sub.Close()
+	}
+	registry.DeleteKey(k, path)
+}
+
+func TestOpenEventLogServiceKeyRemote(t *testing.T) {
+	base := withFakeRemoteKey(t)
+	svcKey, _, err := registry.CreateKey(base, `SYSTEM\CurrentControlSet\Services\EventLog\TestLog\TestSource`, registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("CreateKey: %v", err)
+	}
+	defer svcKey.Close()
+	const want = `%SystemRoot%\System32\kernel32.dll`
+	if err := svcKey.SetStringValue("EventMessageFile", want); err != nil {
+		t.Fatalf("SetStringValue: %v", err)
+	}
+
+	key, err := openEventLogServiceKey("testhost", "TestLog", "TestSource")
+	if err != nil {
+		t.Fatalf("openEventLogServiceKey: %v", err)
+	}
+	defer key.Close()
+
+	got, _, err := key.GetStringValue("EventMessageFile")
+	if err != nil || got != want {
+		t.Errorf("EventMessageFile = %q, %v; want %q, nil", got, err, want)
+	}
+}
+
+func TestOpenEventLogServiceKeyRemoteError(t *testing.T) {
+	orig := registryOpenRemoteKey
+	registryOpenRemoteKey = func(pcname string, k registry.Key) (registry.Key, error) {
+		return 0, errors.New("RPC server unavailable")
+	}
+	defer func() { registryOpenRemoteKey = orig }()
+
+	if _, err := openEventLogServiceKey("unreachable-host", "TestLog", "TestSource"); err == nil {
+		t.Errorf("openEventLogServiceKey: want error when registryOpenRemoteKey fails, got nil")
+	}
+}
+
+func TestGetResourceMessageRemoteFallback(t *testing.T) {
+	orig := registryOpenRemoteKey
+	registryOpenRemoteKey = func(pcname string, k registry.Key) (registry.Key, error) {
+		return 0, errors.New("RPC server unavailable")
+	}
+	defer func() { registryOpenRemoteKey = orig }()
+
+	argStrings := []string{"foo", "bar"}
+	message, err := getResourceMessage("unreachable-host", "TestLog", "TestSource", 1, 0)
+	if err == nil {
+		t.Fatalf("getResourceMessage: want error, got message %q", message)
+	}
+	if got, want := resolveMessage(message, err, "unreachable-host", argStrings), "foo bar"; got != want {
+		t.Errorf("resolveMessage fallback = %q, want %q", got, want)
+	}
+}
+
+func TestRemoteHostPtr(t *testing.T) {
+	if got := remoteHostPtr(""); got != nil {
+		t.Errorf("remoteHostPtr(\"\") = %p, want nil", got)
+	}
+	got := remoteHostPtr("remotehost")
+	if got == nil {
+		t.Fatal("remoteHostPtr(\"remotehost\") = nil, want non-nil")
+	}
+	if s := syscall.UTF16ToString((*[1 << 16]uint16)(unsafe.Pointer(got))[:]); s != "remotehost" {
+		t.Errorf("remoteHostPtr(\"remotehost\") decodes to %q, want %q", s, "remotehost")
+	}
+}
+
+func TestOpenSessionLocal(t *testing.T) {
+	orig := evtOpenSession
+	evtOpenSession = func(computer, user, domain, password string, authFlag uint32) (eventlog.EvtHandle, error) {
+		t.Fatal("evtOpenSession called for local machine, want no call")
+		return 0, nil
+	}
+	defer func() { evtOpenSession = orig }()
+
+	opts := &logOpts{}
+	h, err := opts.openSession()
+	if err != nil || h != 0 {
+		t.Errorf("openSession() = %v, %v, want 0, nil", h, err)
+	}
+}
+
+func TestOpenSessionRemote(t *testing.T) {
+	orig := evtOpenSession
+	var gotComputer, gotUser, gotDomain, gotPassword string
+	var gotAuthFlag uint32
+	evtOpenSession = func(computer, user, domain, password string, authFlag uint32) (eventlog.EvtHandle, error) {
+		gotComputer, gotUser, gotDomain, gotPassword, gotAuthFlag = computer, user, domain, password, authFlag
+		return 42, nil
+	}
+	defer func() { evtOpenSession = orig }()
+
+	opts := &logOpts{Computer: "remotehost", User: "alice", Domain: "CORP", Auth: "kerberos"}
+	opts.password = "hunter2"
+	if err := opts.prepare(); err != nil {
+		t.Fatalf("prepare(): %v", err)
+	}
+	h, err := opts.openSession()
+	if err != nil {
+		t.Fatalf("openSession(): %v", err)
+	}
+	if h != 42 {
+		t.Errorf("openSession() handle = %v, want 42", h)
+	}
+	if gotComputer != "remotehost" || gotUser != "alice" || gotDomain != "CORP" || gotPassword != "hunter2" {
+		t.Errorf("evtOpenSession args = %q %q %q %q, want remotehost alice CORP hunter2", gotComputer, gotUser, gotDomain, gotPassword)
+	}
+	if gotAuthFlag != eventlog.EvtRpcLoginAuthKerberos {
+		t.Errorf("evtOpenSession authFlag = %v, want EvtRpcLoginAuthKerberos", gotAuthFlag)
+	}
+}
+
+func TestBuildXPathFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *logOpts
+		want string
+	}{
+		{
+			name: "no filters",
+			opts: &logOpts{},
+			want: "*",
+		},
+		{
+			name: "plain level",
+			opts: &logOpts{typeList: []string{"Error", "Warning"}},
+			want: "*[System[(Level=2 or Level=3)]]",
+		},
+		{
+			name: "audit types use Keywords band, not Level",
+			opts: &logOpts{typeList: []string{"Audit Success", "Audit Failure"}},
+			want: fmt.Sprintf("*[System[(band(Keywords,%d) or band(Keywords,%d))]]", keywordAuditSuccess, keywordAuditFailure),
+		},
+		{
+			name: "event id include ranges only",
+			opts: &logOpts{idRangeList: []idRange{{lo: 1000, hi: 1000}, {lo: 4625, hi: 4625, bang: true}}},
+			want: "*[System[(EventID>=1000 and EventID<=1000)]]",
+		},
+		{
+			name: "plain source pattern pushes down as contains, not exact equality",
+			opts: func() *logOpts {
+				o := &logOpts{SourcePattern: "App"}
+				o.sourcePattern = regexp.MustCompile(o.SourcePattern)
+				return o
+			}(),
+			want: "*[System[Provider[contains(@Name,'App')]]]",
+		},
+		{
+			name: "source pattern with a quote is never pushed down",
+			opts: func() *logOpts {
+				o := &logOpts{SourcePattern: `App's`}
+				o.sourcePattern = regexp.MustCompile(o.SourcePattern)
+				return o
+			}(),
+			want: "*",
+		},
+		{
+			name: "source pattern with regexp metacharacters is never pushed down",
+			opts: func() *logOpts {
+				o := &logOpts{SourcePattern: "App.*"}
+				o.sourcePattern = regexp.MustCompile(o.SourcePattern)
+				return o
+			}(),
+			want: "*",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.buildXPathFilter(); got != tt.want {
+				t.Errorf("buildXPathFilter() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventIDThresholds(t *testing.T) {
+	got, err := eventIDThresholds([]string{"4625:3", "1102:0"})
+	if err != nil {
+		t.Fatalf("eventIDThresholds: %v", err)
+	}
+	want := map[uint32]int64{4625: 3, 1102: 0}
+	if len(got) != len(want) || got[4625] != 3 || got[1102] != 0 {
+		t.Errorf("eventIDThresholds() = %v, want %v", got, want)
+	}
+
+	if _, err := eventIDThresholds([]string{"notanid:3"}); err == nil {
+		t.Error("eventIDThresholds([\"notanid:3\"]): want error, got nil")
+	}
+	if _, err := eventIDThresholds([]string{"4625"}); err == nil {
+		t.Error("eventIDThresholds([\"4625\"]): want error, got nil")
+	}
+}
+
+func TestLevelRules(t *testing.T) {
+	opts := &logOpts{WarnError: 5, CritError: 10, WarnWarning: 2}
+	rules := opts.levelRules()
+	found := false
+	for _, r := range rules {
+		if r.name == "Error" {
+			found = true
+			if r.warnOver != 5 || r.critOver != 10 {
+				t.Errorf("levelRules() Error rule = %+v, want warnOver=5 critOver=10", r)
+			}
+		}
+	}
+	if !found {
+		t.Error("levelRules(): no Error rule found")
+	}
+}
+
+func TestEventIDRules(t *testing.T) {
+	opts := &logOpts{
+		warnEventIDThresholds: map[uint32]int64{4625: 3, 1102: 1},
+		critEventIDThresholds: map[uint32]int64{4625: 10},
+	}
+	rules := opts.eventIDRules()
+	if len(rules) != 2 {
+		t.Fatalf("eventIDRules() returned %d rules, want 2", len(rules))
+	}
+	// sorted by ID ascending
+	if rules[0].id != 1102 || rules[1].id != 4625 {
+		t.Errorf("eventIDRules() order = %v, want [1102, 4625]", rules)
+	}
+	for _, r := range rules {
+		switch r.id {
+		case 1102:
+			if r.warnOver != 1 || r.critOver != -1 {
+				t.Errorf("eventIDRules() 1102 rule = %+v, want warnOver=1 critOver=-1", r)
+			}
+		case 4625:
+			if r.warnOver != 3 || r.critOver != 10 {
+				t.Errorf("eventIDRules() 4625 rule = %+v, want warnOver=3 critOver=10", r)
+			}
+		}
+	}
+}
+
+func TestEventWriterWriteJSON(t *testing.T) {
+	w := newEventWriter("json")
+	w.Write(matchedEvent{RecordNumber: 1, EventID: 1001, Level: "Error", Provider: "TestSource", Message: "boom"})
+	var got matchedEvent
+	if err := json.Unmarshal([]byte(w.String()), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", w.String(), err)
+	}
+	if got.RecordNumber != 1 || got.EventID != 1001 || got.Level != "Error" || got.Provider != "TestSource" || got.Message != "boom" {
+		t.Errorf("eventWriter json round-trip = %+v, want RecordNumber=1 EventID=1001 Level=Error Provider=TestSource Message=boom", got)
+	}
+}
+
+func TestEventWriterWriteLTSV(t *testing.T) {
+	w := newEventWriter("ltsv")
+	w.Write(matchedEvent{RecordNumber: 1, EventID: 1001, Level: "Error", Provider: "TestSource", Message: "line1\nline2", Data: map[string]string{"key": "va\tlue"}})
+	got := w.String()
+	for _, want := range []string{"record_number:1", "event_id:1001", "level:Error", "provider:TestSource", "message:line1 line2", "data.key:va lue"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("eventWriter ltsv output %q missing field %q", got, want)
+		}
+	}
+	if strings.Contains(got, "\n") {
+		t.Errorf("eventWriter ltsv output %q: message newline was not escaped", got)
+	}
+}
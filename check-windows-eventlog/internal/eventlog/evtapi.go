@@ -0,0 +1,353 @@
+//go:build windows
+// +build windows
+
+package eventlog
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// EvtHandle is a handle returned by the Windows Event Log (Wevtapi.dll) APIs.
+// It is distinct from the legacy HANDLE returned by OpenEventLog and must be
+// closed with EvtClose, not CloseEventLog.
+type EvtHandle uintptr
+
+var (
+	modwevtapi = syscall.NewLazyDLL("wevtapi.dll")
+
+	procEvtQuery                 = modwevtapi.NewProc("EvtQuery")
+	procEvtNext                  = modwevtapi.NewProc("EvtNext")
+	procEvtClose                 = modwevtapi.NewProc("EvtClose")
+	procEvtRender                = modwevtapi.NewProc("EvtRender")
+	procEvtCreateBookmark        = modwevtapi.NewProc("EvtCreateBookmark")
+	procEvtUpdateBookmark        = modwevtapi.NewProc("EvtUpdateBookmark")
+	procEvtOpenPublisherMetadata = modwevtapi.NewProc("EvtOpenPublisherMetadata")
+	procEvtFormatMessage         = modwevtapi.NewProc("EvtFormatMessage")
+	procEvtSeek                  = modwevtapi.NewProc("EvtSeek")
+	procEvtOpenSession           = modwevtapi.NewProc("EvtOpenSession")
+)
+
+// EvtQuery flags (EVT_QUERY_FLAGS).
+const (
+	EvtQueryChannelPath         uint32 = 0x1
+	EvtQueryFilePath            uint32 = 0x2
+	EvtQueryForwardDirection    uint32 = 0x100
+	EvtQueryReverseDirection    uint32 = 0x200
+	EvtQueryTolerateQueryErrors uint32 = 0x1000
+)
+
+// EvtRender flags (EVT_RENDER_FLAGS).
+const (
+	EvtRenderEventValues uint32 = 0
+	EvtRenderEventXml    uint32 = 1
+	EvtRenderBookmark    uint32 = 2
+)
+
+// EvtFormatMessage flags (EVT_FORMAT_MESSAGE_FLAGS). Only the values used by
+// this plugin are declared.
+const (
+	EvtFormatMessageEvent uint32 = 1
+)
+
+// EvtSeek flags (EVT_SEEK_FLAGS).
+const (
+	EvtSeekRelativeToFirst    uint32 = 1
+	EvtSeekRelativeToLast     uint32 = 2
+	EvtSeekRelativeToCurrent  uint32 = 3
+	EvtSeekRelativeToBookmark uint32 = 4
+	EvtSeekStrict             uint32 = 0x10000
+)
+
+// evtLoginClass values (EVT_LOGIN_CLASS). EvtQuery/EvtSubscribe only
+// understand EvtRpcLogin today.
+const evtRpcLogin uint32 = 1
+
+// EVT_RPC_LOGIN_FLAGS, selected by --auth.
+const (
+	EvtRpcLoginAuthDefault   uint32 = 0
+	EvtRpcLoginAuthNegotiate uint32 = 1
+	EvtRpcLoginAuthKerberos  uint32 = 2
+	EvtRpcLoginAuthNTLM      uint32 = 3
+)
+
+// evtRPCLogin mirrors the Win32 EVT_RPC_LOGIN struct passed to EvtOpenSession.
+type evtRPCLogin struct {
+	Server   *uint16
+	User     *uint16
+	Domain   *uint16
+	Password *uint16
+	Flags    uint32
+}
+
+// EvtOpenSession establishes a remote RPC session for EvtQuery/
+// EvtOpenPublisherMetadata against computer. user and domain may be empty to
+// use the caller's own credentials; authFlag is one of the
+// EvtRpcLoginAuth* constants.
+func EvtOpenSession(computer, user, domain, password string, authFlag uint32) (EvtHandle, error) {
+	toPtr := func(s string) (*uint16, error) {
+		if s == "" {
+			return nil, nil
+		}
+		return syscall.UTF16PtrFromString(s)
+	}
+
+	serverPtr, err := toPtr(computer)
+	if err != nil {
+		return 0, err
+	}
+	userPtr, err := toPtr(user)
+	if err != nil {
+		return 0, err
+	}
+	domainPtr, err := toPtr(domain)
+	if err != nil {
+		return 0, err
+	}
+	passwordPtr, err := toPtr(password)
+	if err != nil {
+		return 0, err
+	}
+
+	login := evtRPCLogin{
+		Server:   serverPtr,
+		User:     userPtr,
+		Domain:   domainPtr,
+		Password: passwordPtr,
+		Flags:    authFlag,
+	}
+
+	r0, _, e1 := procEvtOpenSession.Call(
+		uintptr(evtRpcLogin),
+		uintptr(unsafe.Pointer(&login)),
+		0,
+		0,
+	)
+	if r0 == 0 {
+		return 0, e1
+	}
+	return EvtHandle(r0), nil
+}
+
+// EvtQuery runs an XPath query against a channel (or, with EvtQueryFilePath,
+// an exported .evtx file) and returns a handle to the result set.
+func EvtQuery(session EvtHandle, path, query string, flags uint32) (EvtHandle, error) {
+	var pathPtr, queryPtr *uint16
+	var err error
+	if path != "" {
+		pathPtr, err = syscall.UTF16PtrFromString(path)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if query != "" {
+		queryPtr, err = syscall.UTF16PtrFromString(query)
+		if err != nil {
+			return 0, err
+		}
+	}
+	r0, _, e1 := procEvtQuery.Call(
+		uintptr(session),
+		uintptr(unsafe.Pointer(pathPtr)),
+		uintptr(unsafe.Pointer(queryPtr)),
+		uintptr(flags),
+	)
+	if r0 == 0 {
+		return 0, e1
+	}
+	return EvtHandle(r0), nil
+}
+
+// EvtNext pulls up to len(events) handles out of a result set produced by
+// EvtQuery. It returns the events actually returned; a nil, nil return means
+// the result set is exhausted.
+func EvtNext(resultSet EvtHandle, events []EvtHandle, timeout uint32) ([]EvtHandle, error) {
+	var returned uint32
+	r0, _, e1 := procEvtNext.Call(
+		uintptr(resultSet),
+		uintptr(len(events)),
+		uintptr(unsafe.Pointer(&events[0])),
+		uintptr(timeout),
+		0,
+		uintptr(unsafe.Pointer(&returned)),
+	)
+	if r0 == 0 {
+		if e1 == syscall.Errno(259) { // ERROR_NO_MORE_ITEMS
+			return nil, nil
+		}
+		return nil, e1
+	}
+	return events[:returned], nil
+}
+
+// EvtClose closes any handle returned by the Evt* APIs (events, result sets,
+// bookmarks, sessions, publisher metadata).
+func EvtClose(h EvtHandle) error {
+	r0, _, e1 := procEvtClose.Call(uintptr(h))
+	if r0 == 0 {
+		return e1
+	}
+	return nil
+}
+
+// evtRender is the low-level two-call-pattern wrapper shared by RenderEventXML
+// and RenderBookmark. EvtRender always writes UTF-16LE text, so the raw
+// buffer is decoded to UTF-8 before it's handed back, the same way
+// EvtFormatMessage decodes its own UTF-16LE output below.
+func evtRender(fragment EvtHandle, flags uint32) ([]byte, error) {
+	var bufferUsed, propertyCount uint32
+	_, _, e1 := procEvtRender.Call(
+		0,
+		uintptr(fragment),
+		uintptr(flags),
+		0,
+		0,
+		uintptr(unsafe.Pointer(&bufferUsed)),
+		uintptr(unsafe.Pointer(&propertyCount)),
+	)
+	if e1 != syscall.ERROR_INSUFFICIENT_BUFFER {
+		return nil, e1
+	}
+
+	buf := make([]byte, bufferUsed)
+	r0, _, e1 := procEvtRender.Call(
+		0,
+		uintptr(fragment),
+		uintptr(flags),
+		uintptr(len(buf)),
+		uintptr(unsafe.Pointer(&buf[0])),
+		uintptr(unsafe.Pointer(&bufferUsed)),
+		uintptr(unsafe.Pointer(&propertyCount)),
+	)
+	if r0 == 0 {
+		return nil, e1
+	}
+	return []byte(utf16BufToString(buf[:bufferUsed])), nil
+}
+
+// utf16BufToString decodes a UTF-16LE byte buffer, as returned by EvtRender,
+// into a UTF-8 string, stopping at the first NUL like syscall.UTF16ToString.
+func utf16BufToString(b []byte) string {
+	u16 := make([]uint16, len(b)/2)
+	for i := range u16 {
+		u16[i] = uint16(b[i*2]) | uint16(b[i*2+1])<<8
+	}
+	return syscall.UTF16ToString(u16)
+}
+
+// RenderEventXML renders an event handle (as returned by EvtNext) into its
+// full XML representation, decoded to UTF-8 and ready for xml.Unmarshal.
+func RenderEventXML(event EvtHandle) ([]byte, error) {
+	return evtRender(event, EvtRenderEventXml)
+}
+
+// RenderBookmark renders a bookmark handle into its XML representation so it
+// can be persisted to a state file.
+func RenderBookmark(bookmark EvtHandle) ([]byte, error) {
+	return evtRender(bookmark, EvtRenderBookmark)
+}
+
+// EvtCreateBookmark creates a bookmark handle, optionally seeded from a
+// previously rendered bookmark XML. Pass "" to create an empty bookmark that
+// can later be positioned with EvtUpdateBookmark.
+func EvtCreateBookmark(bookmarkXML string) (EvtHandle, error) {
+	var ptr *uint16
+	var err error
+	if bookmarkXML != "" {
+		ptr, err = syscall.UTF16PtrFromString(bookmarkXML)
+		if err != nil {
+			return 0, err
+		}
+	}
+	r0, _, e1 := procEvtCreateBookmark.Call(uintptr(unsafe.Pointer(ptr)))
+	if r0 == 0 {
+		return 0, e1
+	}
+	return EvtHandle(r0), nil
+}
+
+// EvtUpdateBookmark repositions a bookmark handle to the given event, so that
+// a subsequent RenderBookmark captures the event's position in the channel.
+func EvtUpdateBookmark(bookmark, event EvtHandle) error {
+	r0, _, e1 := procEvtUpdateBookmark.Call(uintptr(bookmark), uintptr(event))
+	if r0 == 0 {
+		return e1
+	}
+	return nil
+}
+
+// EvtSeek repositions a result set produced by EvtQuery, most commonly to
+// the event just after a bookmark via EvtSeekRelativeToBookmark so that a
+// resumed query only yields events the plugin hasn't reported yet.
+func EvtSeek(resultSet EvtHandle, offset int64, bookmark EvtHandle, flags uint32) error {
+	r0, _, e1 := procEvtSeek.Call(
+		uintptr(resultSet),
+		uintptr(offset),
+		uintptr(bookmark),
+		0,
+		uintptr(flags),
+	)
+	if r0 == 0 {
+		return e1
+	}
+	return nil
+}
+
+// EvtOpenPublisherMetadata opens the publisher metadata used by
+// EvtFormatMessage to resolve an event's message template. session is 0 for
+// local queries.
+func EvtOpenPublisherMetadata(session EvtHandle, publisherID string) (EvtHandle, error) {
+	ptr, err := syscall.UTF16PtrFromString(publisherID)
+	if err != nil {
+		return 0, err
+	}
+	r0, _, e1 := procEvtOpenPublisherMetadata.Call(
+		uintptr(session),
+		uintptr(unsafe.Pointer(ptr)),
+		0,
+		0,
+		0,
+	)
+	if r0 == 0 {
+		return 0, e1
+	}
+	return EvtHandle(r0), nil
+}
+
+// EvtFormatMessage resolves the display message for event using the given
+// publisher metadata handle. It is the EvtQuery-era counterpart to the
+// legacy FormatMessage used by getResourceMessage.
+func EvtFormatMessage(publisherMetadata, event EvtHandle, flags uint32) (string, error) {
+	var bufferUsed uint32
+	_, _, e1 := procEvtFormatMessage.Call(
+		uintptr(publisherMetadata),
+		uintptr(event),
+		0,
+		0,
+		0,
+		uintptr(flags),
+		0,
+		0,
+		uintptr(unsafe.Pointer(&bufferUsed)),
+	)
+	if e1 != syscall.ERROR_INSUFFICIENT_BUFFER {
+		return "", e1
+	}
+
+	buf := make([]uint16, bufferUsed)
+	r0, _, e1 := procEvtFormatMessage.Call(
+		uintptr(publisherMetadata),
+		uintptr(event),
+		0,
+		0,
+		0,
+		uintptr(flags),
+		uintptr(bufferUsed),
+		uintptr(unsafe.Pointer(&buf[0])),
+		uintptr(unsafe.Pointer(&bufferUsed)),
+	)
+	if r0 == 0 {
+		return "", e1
+	}
+	return syscall.UTF16ToString(buf), nil
+}